@@ -0,0 +1,370 @@
+// Package api holds tsukurogami's HTTP handlers: the pull-request webhook
+// endpoint, the Xcode integration-status callback, and the log viewer.
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Didact/Tsukurogami/logstore"
+	"github.com/Didact/Tsukurogami/metrics"
+	"github.com/Didact/Tsukurogami/queue"
+	"github.com/Didact/Tsukurogami/scm"
+	"github.com/Didact/Tsukurogami/xcode"
+)
+
+// errorHandler is an http.Handler that writes the handled request's error
+// (if any) to the response body and the log.
+type errorHandler func(http.ResponseWriter, *http.Request) error
+
+func (e errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := e(w, r)
+
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintf(w, "%s", err)
+	log.Println(err)
+}
+
+// ErrorHandler adapts an (http.ResponseWriter, *http.Request) error
+// function into an http.Handler.
+func ErrorHandler(f func(http.ResponseWriter, *http.Request) error) http.Handler {
+	return errorHandler(f)
+}
+
+// Metrics is the set of Prometheus collectors HandleJob and
+// HandleIntegrationUpdated report to.
+type Metrics struct {
+	BotsCreated         *metrics.CounterVec   // {repo}
+	BotsDeleted         *metrics.CounterVec   // {repo}
+	Integrations        *metrics.CounterVec   // {repo,branch,status}
+	IntegrationDuration *metrics.HistogramVec // {repo}, seconds between inprogress and a terminal status
+}
+
+// NewMetrics registers api's collectors on reg.
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		BotsCreated:  reg.NewCounterVec("tsukurogami_bots_created_total", "Bots created, by repo.", "repo"),
+		BotsDeleted:  reg.NewCounterVec("tsukurogami_bots_deleted_total", "Bots deleted, by repo.", "repo"),
+		Integrations: reg.NewCounterVec("tsukurogami_integrations_total", "Integration results reported, by repo, branch, and status.", "repo", "branch", "status"),
+		IntegrationDuration: reg.NewHistogramVec("tsukurogami_integration_duration_seconds",
+			"Time between an integration's inprogress and terminal status, by repo.",
+			[]float64{5, 15, 30, 60, 120, 300, 600, 1200}, "repo"),
+	}
+}
+
+// Server holds the dependencies tsukurogami's handlers need: an XcodeClient
+// for bot mutation (so tests can swap in a fake), an SCM for parsing
+// webhooks and posting build statuses (so alternate backends like GitHub or
+// Gitea can be swapped in for Bitbucket), a log store for structured,
+// filterable per-PR logging, a job Queue that serializes bot mutations per
+// repo/branch off the request goroutine, and Metrics for /metrics.
+type Server struct {
+	Xcode   xcode.XcodeClient
+	SCM     scm.SCM
+	Logs    *logstore.Store
+	Queue   *queue.Queue
+	Metrics *Metrics
+	MyIP    string
+	Port    int
+
+	// integrationStarts tracks when each in-flight integration (keyed by
+	// "bot:integration") went inprogress, so HandleIntegrationUpdated can
+	// report IntegrationDuration once it reaches a terminal status.
+	mu                sync.Mutex
+	integrationStarts map[string]time.Time
+}
+
+// NewServer returns a Server wired up to xc, sc, logs, and m. Its Queue
+// field is left nil; set it once a queue.Queue has been built with
+// s.HandleJob as its handler (the two are circular: the queue needs
+// s.HandleJob, and s needs the queue to enqueue jobs from
+// HandlePullRequestUpdated).
+func NewServer(xc xcode.XcodeClient, sc scm.SCM, logs *logstore.Store, m *Metrics, myIP string, port int) *Server {
+	return &Server{
+		Xcode:             xc,
+		SCM:               sc,
+		Logs:              logs,
+		Metrics:           m,
+		MyIP:              myIP,
+		Port:              port,
+		integrationStarts: make(map[string]time.Time),
+	}
+}
+
+// markIntegrationStarted records that the integration named key just went
+// inprogress.
+func (s *Server) markIntegrationStarted(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.integrationStarts[key] = time.Now()
+}
+
+// takeIntegrationStart returns and forgets the inprogress time recorded for
+// key, if any.
+func (s *Server) takeIntegrationStart(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.integrationStarts[key]
+	if ok {
+		delete(s.integrationStarts, key)
+	}
+	return t, ok
+}
+
+func (s *Server) HandlePullRequestUpdated(w http.ResponseWriter, r *http.Request) error {
+	event, err := s.SCM.ParseWebhook(r)
+	if err != nil {
+		if err == scm.ErrInvalidSignature {
+			w.WriteHeader(403)
+		} else {
+			w.WriteHeader(400)
+		}
+		return err
+	}
+
+	entry := s.Logs.With(event.Repo, event.Branch)
+
+	switch event.Action {
+	case scm.ActionOpened, scm.ActionReopened:
+		entry.Infof("enqueueing create")
+		s.Queue.Enqueue(queue.Job{Kind: queue.KindCreate, Repo: event.Repo, Branch: event.Branch})
+	case scm.ActionClosed:
+		entry.Infof("enqueueing delete")
+		s.Queue.Enqueue(queue.Job{Kind: queue.KindDelete, Repo: event.Repo, Branch: event.Branch})
+	case scm.ActionSynchronize:
+		entry.Infof("enqueueing integrate")
+		s.Queue.Enqueue(queue.Job{Kind: queue.KindIntegrate, Repo: event.Repo, Branch: event.Branch})
+	default:
+		// nop
+		return fmt.Errorf("unknown action: %s\n", event.Action)
+	}
+
+	w.WriteHeader(202)
+	return nil
+}
+
+// HandleJob runs a single queued job. It's the queue.Handler backing
+// s.Queue, pulled off the HTTP goroutine by a worker pool (see
+// queue.Queue.Run), so a slow Xcode duplication no longer blocks the
+// webhook handler or races another job for the same repo/branch.
+func (s *Server) HandleJob(ctx context.Context, job queue.Job) error {
+	entry := s.Logs.With(job.Repo, job.Branch)
+
+	switch job.Kind {
+	case queue.KindCreate:
+		entry.Infof("creating bot")
+		if err := s.createBot(ctx, entry, job.Repo, job.Branch); err != nil {
+			entry.Errorf("%s", err)
+			return err
+		}
+		entry.Infof("successfully created bot")
+		entry.Infof("updating bot")
+		if err := s.integrateBot(ctx, entry, job.Repo, job.Branch); err != nil {
+			entry.Errorf("%s", err)
+			return err
+		}
+		entry.Infof("successfully updated bot")
+	case queue.KindDelete:
+		entry.Infof("deleting bot")
+		if err := s.deleteBot(ctx, entry, job.Repo, job.Branch); err != nil {
+			entry.Errorf("%s", err)
+			return err
+		}
+		entry.Infof("successfully deleted bot")
+	case queue.KindIntegrate:
+		entry.Infof("updating bot")
+		if err := s.integrateBot(ctx, entry, job.Repo, job.Branch); err != nil {
+			entry.Errorf("%s", err)
+			return err
+		}
+		entry.Infof("successfully updated bot")
+	default:
+		return fmt.Errorf("HandleJob: unknown job kind: %s", job.Kind)
+	}
+
+	return nil
+}
+
+func (s *Server) HandleIntegrationUpdated(w http.ResponseWriter, r *http.Request) error {
+	success := false
+	defer func() {
+		if success {
+			w.WriteHeader(200)
+		} else {
+			w.WriteHeader(500)
+		}
+	}()
+
+	commit, ok := r.URL.Query()["commit"]
+	if !ok || len(commit) < 1 {
+		return fmt.Errorf(`%s no "commit" parameter`, r.URL)
+	}
+	status, ok := r.URL.Query()["status"]
+	if !ok || len(status) < 1 {
+		return fmt.Errorf(`%s no "status" parameter`, r.URL)
+	}
+	bot, ok := r.URL.Query()["bot"]
+	if !ok || len(bot) < 1 {
+		return fmt.Errorf(`%s no "bot" parameter`, r.URL)
+	}
+
+	integration, ok := r.URL.Query()["integration"]
+	if !ok || len(integration) < 1 {
+		return fmt.Errorf(`%s no "integration" parameter`, r.URL)
+	}
+
+	var state scm.Status
+
+	switch strings.ToLower(status[0]) {
+	case "inprogress":
+		state.State = scm.StateInProgress
+	case "succeeded", "warnings":
+		state.State = scm.StateSuccess
+	case "trigger-error", "internal-build-error", "build-errors":
+		state.State = scm.StateFailure
+	default:
+		state.State = scm.StateFailure
+		state.Desc = "xcode returned: " + status[0]
+	}
+	state.Key = bot[0]
+	state.Name = state.Key + ":" + integration[0]
+	state.URL = "http://example.com/" // dunno what to do with this yet
+
+	entry := s.Logs.With("", "").WithBot(bot[0]).WithIntegration(integration[0])
+
+	var repo, branch string
+	if b, err := xcode.BotNamed(r.Context(), s.Xcode, bot[0]); err != nil {
+		entry.Errorf("HandleIntegrationUpdated: couldn't look up repo for bot %s: %s", bot[0], err)
+	} else {
+		if v, ok := b.Config.EnvVars()["TSUKUROGAMI_REPO"].(string); ok {
+			repo = v
+		}
+		if v, ok := b.Config.EnvVars()["TSUKUROGAMI_BRANCH"].(string); ok {
+			branch = v
+		}
+		entry = s.Logs.With(repo, branch).WithBot(bot[0]).WithIntegration(integration[0])
+	}
+
+	entry.Infof("integration %s -> %s", integration[0], state.State)
+
+	switch state.State {
+	case scm.StateInProgress:
+		s.markIntegrationStarted(state.Name)
+	case scm.StateSuccess, scm.StateFailure:
+		if started, ok := s.takeIntegrationStart(state.Name); ok {
+			s.Metrics.IntegrationDuration.Observe(time.Since(started).Seconds(), repo)
+		}
+	}
+	s.Metrics.Integrations.Inc(repo, branch, state.State.String())
+
+	if err := s.SCM.PostBuildStatus(repo, commit[0], state); err != nil {
+		return fmt.Errorf("HandleIntegrationUpdated: %s", err)
+	}
+
+	success = true
+	return nil
+}
+
+func (s *Server) createBot(ctx context.Context, entry *logstore.Entry, repo, branch string) error {
+	templateBots, err := xcode.BotsWhere(ctx, s.Xcode, func(b *xcode.Bot) bool {
+		r, ok := b.Config.EnvVars()["TSUKUROGAMI_REPO_TEMPLATE"].(string)
+		if !ok {
+			return false
+		}
+		return strings.ToLower(r) == strings.ToLower(repo)
+	})
+	if err != nil {
+		return fmt.Errorf("createBot %s %s: %s", repo, branch, err)
+	}
+
+	if len(templateBots) < 1 {
+		return fmt.Errorf("createBot %s %s: no templates for repo", repo, branch)
+	}
+
+	for _, templateBot := range templateBots {
+		id := templateBot.ID
+
+		templateBot.Config.SetTriggers(append([]xcode.Trigger{
+			xcode.SwitchBranchTrigger(branch),
+			xcode.PrePoke(s.MyIP, s.Port),
+			xcode.PostPoke(s.MyIP, s.Port),
+		}, templateBot.Config.Triggers()...))
+		templateBot.Config.EnvVars()["TSUKUROGAMI_REPO"] = repo
+		templateBot.Config.EnvVars()["TSUKUROGAMI_BRANCH"] = branch
+		delete(templateBot.Config.EnvVars(), "TSUKUROGAMI_REPO_TEMPLATE")
+		templateBot.Name = templateBot.Name + "." + branch
+		templateBot.ID = ""
+
+		templateBot.Config.SetScheduleType(3)
+
+		entry.WithBot(templateBot.Name).Infof("duplicating template bot %s", id)
+		if err := s.Xcode.Duplicate(ctx, id, *templateBot); err != nil {
+			return fmt.Errorf("createBot %s %s: %s", repo, branch, err)
+		}
+		s.Metrics.BotsCreated.Inc(repo)
+	}
+
+	return nil
+}
+
+func (s *Server) deleteBot(ctx context.Context, entry *logstore.Entry, repo, branch string) error {
+	bs, err := s.botsForRepoBranch(ctx, repo, branch)
+	if err != nil {
+		return fmt.Errorf("deleteBot %s %s: %s", repo, branch, err)
+	}
+
+	for _, b := range bs {
+		entry.WithBot(b.Name).Infof("deleting bot %s", b.ID)
+		if err := s.Xcode.DeleteBot(ctx, b.ID); err != nil {
+			return fmt.Errorf("deleteBot %s %s: %s", repo, branch, err)
+		}
+		s.Metrics.BotsDeleted.Inc(repo)
+	}
+
+	return nil
+}
+
+func (s *Server) integrateBot(ctx context.Context, entry *logstore.Entry, repo, branch string) error {
+	bs, err := s.botsForRepoBranch(ctx, repo, branch)
+	if err != nil {
+		return fmt.Errorf("integrateBot %s %s: %s", repo, branch, err)
+	}
+
+	for _, b := range bs {
+		entry.WithBot(b.Name).Infof("integrating bot %s", b.ID)
+		if err := s.Xcode.Integrate(ctx, b.ID); err != nil {
+			return fmt.Errorf("integrateBot %s %s: %s", repo, branch, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) botsForRepoBranch(ctx context.Context, repo, branch string) ([]*xcode.Bot, error) {
+	bs, err := xcode.BotsWhere(ctx, s.Xcode, func(b *xcode.Bot) bool {
+		if r, ok := b.Config.EnvVars()["TSUKUROGAMI_REPO"].(string); !ok || (strings.ToLower(r) != strings.ToLower(repo)) {
+			return false
+		}
+		if br, ok := b.Config.EnvVars()["TSUKUROGAMI_BRANCH"].(string); !ok || (strings.ToLower(br) != strings.ToLower(branch)) {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bs) < 1 {
+		return nil, fmt.Errorf("no bots found")
+	}
+
+	return bs, nil
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Didact/Tsukurogami/logstore"
+	"github.com/Didact/Tsukurogami/metrics"
+	"github.com/Didact/Tsukurogami/queue"
+	"github.com/Didact/Tsukurogami/xcode"
+)
+
+// fakeXcode is an in-memory xcode.XcodeClient good enough to exercise
+// createBot/integrateBot without a real Xcode Server.
+type fakeXcode struct {
+	bots       []xcode.Bot
+	nextID     int
+	integrated []string // bot IDs passed to Integrate, in call order
+}
+
+func (f *fakeXcode) ListBots(ctx context.Context) ([]xcode.Bot, error) {
+	// Round-trip each bot through JSON, the same as a real Xcode Server
+	// response would: Configuration's maps are shared by Go value copies,
+	// but not across an actual network boundary.
+	out := make([]xcode.Bot, len(f.bots))
+	for i, b := range f.bots {
+		cloned, err := cloneBot(b)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = cloned
+	}
+	return out, nil
+}
+
+func cloneBot(b xcode.Bot) (xcode.Bot, error) {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return xcode.Bot{}, err
+	}
+	var clone xcode.Bot
+	if err := json.Unmarshal(buf, &clone); err != nil {
+		return xcode.Bot{}, err
+	}
+	return clone, nil
+}
+
+func (f *fakeXcode) CreateBot(ctx context.Context, bot xcode.Bot) (xcode.Bot, error) {
+	return xcode.Bot{}, fmt.Errorf("fakeXcode: CreateBot not implemented")
+}
+
+func (f *fakeXcode) DeleteBot(ctx context.Context, id string) error {
+	for i, b := range f.bots {
+		if b.ID == id {
+			f.bots = append(f.bots[:i], f.bots[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("fakeXcode: no bot %s", id)
+}
+
+func (f *fakeXcode) Integrate(ctx context.Context, id string) error {
+	f.integrated = append(f.integrated, id)
+	return nil
+}
+
+func (f *fakeXcode) Duplicate(ctx context.Context, id string, bot xcode.Bot) error {
+	clone, err := cloneBot(bot)
+	if err != nil {
+		return err
+	}
+	clone.ID = fmt.Sprintf("dup-%d", f.nextID)
+	f.nextID++
+	f.bots = append(f.bots, clone)
+	return nil
+}
+
+// configWithEnv builds a Configuration with the given buildEnvironmentVariables,
+// round-tripping through JSON since Configuration's fields are unexported.
+func configWithEnv(t *testing.T, env map[string]interface{}) xcode.Configuration {
+	t.Helper()
+	var cfg xcode.Configuration
+	doc := map[string]interface{}{
+		"triggers":                  []xcode.Trigger{},
+		"buildEnvironmentVariables": env,
+		"scheduleType":              0,
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("configWithEnv: %s", err)
+	}
+	if err := cfg.UnmarshalJSON(b); err != nil {
+		t.Fatalf("configWithEnv: %s", err)
+	}
+	return cfg
+}
+
+func TestHandleJob_CreateIntegratesTheNewBot(t *testing.T) {
+	logs, err := logstore.New("", 100, 0)
+	if err != nil {
+		t.Fatalf("logstore.New: %s", err)
+	}
+
+	fx := &fakeXcode{
+		bots: []xcode.Bot{{
+			ID:     "template",
+			Name:   "Template",
+			Config: configWithEnv(t, map[string]interface{}{"TSUKUROGAMI_REPO_TEMPLATE": "org/repo"}),
+		}},
+	}
+
+	s := NewServer(fx, nil, logs, NewMetrics(metrics.NewRegistry()), "localhost", 4444)
+
+	if err := s.HandleJob(context.Background(), queue.Job{Kind: queue.KindCreate, Repo: "org/repo", Branch: "feature"}); err != nil {
+		t.Fatalf("HandleJob(create): %s", err)
+	}
+
+	if len(fx.integrated) != 1 {
+		t.Fatalf("integrated = %v, want exactly one bot integrated after create", fx.integrated)
+	}
+	if fx.integrated[0] != "dup-0" {
+		t.Fatalf("integrated bot = %q, want the bot duplicated from the template", fx.integrated[0])
+	}
+}
@@ -0,0 +1,374 @@
+// Package bitbucket posts build statuses to Bitbucket Server/Cloud and
+// authenticates to it, either with a static Basic credential or a rotating
+// OAuth access token.
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Didact/Tsukurogami/metrics"
+	"github.com/Didact/Tsukurogami/scm"
+)
+
+// BuildState is a Bitbucket build-status document, posted to
+// /rest/build-status/1.0/commits/{commit}.
+type BuildState struct {
+	State string `json:"state"`
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	URL   string `json:"url"`
+	Desc  string `json:"description,omitempty"`
+}
+
+// PostBuildStatus posts state for commit to baseURL (tsukurogami's
+// config.Config.BitbucketURL) using client.
+func PostBuildStatus(client *http.Client, baseURL string, commit string, state BuildState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+	u.Path = path.Join(path.Join(u.Path, "rest/build-status/1.0/commits/"), commit)
+
+	resp, err := client.Post(u.String(), "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("PostBuildStatus: RPC failed (code: %d)", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// transport injects a static Basic credential into every request. If
+// timeout is set, it also bounds every round trip with a deadline, so a
+// wedged Bitbucket server can't hang a webhook handler forever.
+type transport struct {
+	*http.Transport
+	creds   string
+	timeout time.Duration
+}
+
+// NewTransport returns an http.RoundTripper that authenticates to Bitbucket
+// with creds ("username:password") and bounds every request to timeout
+// (zero disables the deadline).
+func NewTransport(creds string, skipVerify bool, timeout time.Duration) http.RoundTripper {
+	return transport{creds: creds, timeout: timeout, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify}}}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(t.creds)))
+	req.Header.Add("Authorization", auth)
+	return withDeadline(t.Transport, req, t.timeout)
+}
+
+// withDeadline runs req through rt, bounded by timeout (if set), and defers
+// releasing the deadline's context until the response body is closed,
+// since callers are still reading the body after RoundTrip returns.
+func withDeadline(rt http.RoundTripper, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return rt.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's deadline context once its response
+// body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// Credentials is a rotatable OAuth token pair. It's mutated in place by a
+// Refresher, and OAuthTransport persists it back to disk (via Persist) after
+// every successful refresh.
+type Credentials struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Refresher obtains a new access token for creds, updating it in place. The
+// bool return mirrors Drone's remote.Refresher: true means creds changed and
+// should be persisted, false means nothing to do (e.g. the token isn't
+// expired after all).
+type Refresher interface {
+	Refresh(creds *Credentials) (bool, error)
+}
+
+// OAuthRefresher implements the standard OAuth2 refresh_token grant against
+// a Bitbucket Server/Cloud OAuth app.
+type OAuthRefresher struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+}
+
+func (r *OAuthRefresher) Refresh(creds *Credentials) (bool, error) {
+	if creds.RefreshToken == "" {
+		return false, errors.New("OAuthRefresher: no refresh token")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", creds.RefreshToken)
+	form.Set("client_id", r.ClientID)
+	form.Set("client_secret", r.ClientSecret)
+
+	resp, err := r.HTTPClient.PostForm(r.TokenURL, form)
+	if err != nil {
+		return false, fmt.Errorf("OAuthRefresher: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("OAuthRefresher: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("OAuthRefresher: token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var tok struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return false, fmt.Errorf("OAuthRefresher: %s", err)
+	}
+
+	creds.AccessToken = tok.AccessToken
+	if tok.RefreshToken != "" {
+		// Bitbucket doesn't always rotate the refresh token; keep the old
+		// one around if a new one wasn't issued.
+		creds.RefreshToken = tok.RefreshToken
+	}
+
+	return true, nil
+}
+
+// OAuthTransport authenticates with a rotating OAuth access token rather
+// than a static Basic credential. On a 401 it asks Refresher for a new
+// token, calls Persist with the result, and retries the request once.
+type OAuthTransport struct {
+	*http.Transport
+	m         sync.Mutex
+	Creds     *Credentials
+	Refresher Refresher
+	// Persist is called with Creds after every successful refresh, so the
+	// caller can write the new tokens back to its config file. May be nil.
+	Persist func(*Credentials) error
+	// Timeout bounds every round trip with a deadline. Zero disables it.
+	Timeout time.Duration
+}
+
+// NewOAuthTransport returns an OAuthTransport for creds, refreshed via
+// refresher on a 401, with every request bounded by timeout (zero disables
+// it).
+func NewOAuthTransport(creds *Credentials, refresher Refresher, persist func(*Credentials) error, skipVerify bool, timeout time.Duration) *OAuthTransport {
+	return &OAuthTransport{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify}},
+		Creds:     creds,
+		Refresher: refresher,
+		Persist:   persist,
+		Timeout:   timeout,
+	}
+}
+
+func (t *OAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	token := t.Creds.AccessToken
+	t.m.Unlock()
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := withDeadline(t.Transport, req, t.Timeout)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	ok, err := t.Refresher.Refresh(t.Creds)
+	if err != nil {
+		return nil, fmt.Errorf("OAuthTransport: refresh: %s", err)
+	}
+	if !ok {
+		return nil, errors.New("OAuthTransport: refresh did not produce a new token")
+	}
+
+	if t.Persist != nil {
+		if err := t.Persist(t.Creds); err != nil {
+			return nil, fmt.Errorf("OAuthTransport: persist: %s", err)
+		}
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("OAuthTransport: %s", err)
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", "Bearer "+t.Creds.AccessToken)
+
+	return withDeadline(t.Transport, retry, t.Timeout)
+}
+
+// SCM adapts an authenticated Bitbucket Server client to the scm.SCM
+// interface, so it can sit behind tsukurogami's pull-request handler
+// alongside GitHub/Gitea.
+type SCM struct {
+	HTTPClient *http.Client
+	BaseURL    string
+	// WebhookSecret, if set, must match the request's X-Hub-Signature
+	// HMAC, same as GitHub's X-Hub-Signature-256 (Bitbucket Server/Data
+	// Center 5.4+ signs webhooks this way too).
+	WebhookSecret string
+	// rpcErrors, if set, counts failed RPCs by operation name
+	// (tsukurogami_bitbucket_rpc_errors_total{op}).
+	rpcErrors *metrics.CounterVec
+}
+
+// NewSCM returns a Bitbucket scm.SCM backed by client. rpcErrors may be nil
+// to disable RPC error counting.
+func NewSCM(client *http.Client, baseURL, webhookSecret string, rpcErrors *metrics.CounterVec) *SCM {
+	return &SCM{HTTPClient: client, BaseURL: baseURL, WebhookSecret: webhookSecret, rpcErrors: rpcErrors}
+}
+
+// bitbucketWebhook is the subset of Bitbucket Server's pull request webhook
+// payload tsukurogami cares about.
+type bitbucketWebhook struct {
+	PullRequest struct {
+		FromRef struct {
+			DisplayID    string `json:"displayId"`
+			LatestCommit string `json:"latestCommit"`
+			Repository   struct {
+				Slug    string `json:"slug"`
+				Project struct {
+					Key string `json:"key"`
+				} `json:"project"`
+			} `json:"repository"`
+		} `json:"fromRef"`
+	} `json:"pullRequest"`
+}
+
+func (s *SCM) ParseWebhook(r *http.Request) (scm.Event, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return scm.Event{}, fmt.Errorf("ParseWebhook: %s", err)
+	}
+
+	if s.WebhookSecret != "" {
+		if !validSignature(body, s.WebhookSecret, r.Header.Get("X-Hub-Signature")) {
+			return scm.Event{}, scm.ErrInvalidSignature
+		}
+	}
+
+	var payload bitbucketWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return scm.Event{}, fmt.Errorf("ParseWebhook: %s", err)
+	}
+
+	event := scm.Event{
+		Repo:   payload.PullRequest.FromRef.Repository.Project.Key + "/" + payload.PullRequest.FromRef.Repository.Slug,
+		Branch: payload.PullRequest.FromRef.DisplayID,
+		Commit: payload.PullRequest.FromRef.LatestCommit,
+	}
+
+	switch r.Header.Get("X-Event-Key") {
+	case "pr:opened":
+		event.Action = scm.ActionOpened
+	case "pr:from_ref_updated":
+		event.Action = scm.ActionSynchronize
+	case "pr:declined", "pr:merged", "pr:deleted":
+		event.Action = scm.ActionClosed
+	default:
+		event.Action = scm.ActionUnknown
+	}
+
+	return event, nil
+}
+
+func validSignature(body []byte, secret, header string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	want, err := hex.DecodeString(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	got := mac.Sum(nil)
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func (s *SCM) PostBuildStatus(repo, commit string, status scm.Status) error {
+	var state string
+	switch status.State {
+	case scm.StateSuccess:
+		state = "SUCCESSFUL"
+	case scm.StateFailure:
+		state = "FAILED"
+	default:
+		state = "INPROGRESS"
+	}
+
+	err := PostBuildStatus(s.HTTPClient, s.BaseURL, commit, BuildState{
+		State: state,
+		Key:   status.Key,
+		Name:  status.Name,
+		URL:   status.URL,
+		Desc:  status.Desc,
+	})
+	if err != nil && s.rpcErrors != nil {
+		s.rpcErrors.Inc("PostBuildStatus")
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+// Package config owns tsukurogami's JSON/flag-driven configuration,
+// including the URL flag.Value wrapper shared by every server address.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration that can be used as a flag.Value and that
+// marshals to and from JSON as a duration string (e.g. "30s") instead of a
+// bare number of nanoseconds.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+func (d *Duration) String() string {
+	return d.Duration.String()
+}
+
+func (d *Duration) Set(s string) error {
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+// URL is a *url.URL that can be used as a flag.Value and that marshals to
+// and from JSON as a plain string.
+type URL struct {
+	// embedded because an alias requires too much casting IMO
+	*url.URL
+}
+
+func (u URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.String())
+}
+
+func (u *URL) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	u2, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	u.URL = u2
+	return nil
+}
+
+func (u *URL) String() string {
+	if u == nil || u.URL == nil {
+		return ""
+	}
+	return u.URL.String()
+}
+
+func (u *URL) Set(s string) error {
+	u2, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	u.URL = u2
+	return nil
+}
+
+// Config is tsukurogami's full configuration, loadable either from flags or
+// from a JSON file passed via -config.
+type Config struct {
+	XcodeURL             URL    `json:"xcodeURL"`
+	BitbucketURL         URL    `json:"bitbucketURL"`
+	XcodeCredentials     string `json:"xcodeCredentials"`
+	BitbucketCredentials string `json:"bitbucketCredentials"`
+	Port                 int    `json:"port"`
+	SkipVerify           bool   `json:"skipVerify"`
+
+	// XcodeTimeout/BitbucketTimeout bound every single HTTP round trip to
+	// their respective servers (via the transport wrapper, not the handler
+	// as a whole), so a wedged server can't hang the webhook handler
+	// forever. Zero disables the deadline.
+	XcodeTimeout     Duration `json:"xcodeTimeout,omitempty"`
+	BitbucketTimeout Duration `json:"bitbucketTimeout,omitempty"`
+
+	// OAuth support for Bitbucket Server / Cloud apps, as an alternative to
+	// BitbucketCredentials. When BitbucketOAuth is set, the bitbucket client
+	// uses a rotating OAuth access token instead of basic auth, and
+	// AccessToken/RefreshToken are kept up to date on disk as they're
+	// rotated.
+	BitbucketOAuth        bool   `json:"bitbucketOAuth,omitempty"`
+	BitbucketClientID     string `json:"bitbucketClientID,omitempty"`
+	BitbucketClientSecret string `json:"bitbucketClientSecret,omitempty"`
+	BitbucketTokenURL     URL    `json:"bitbucketTokenURL,omitempty"`
+	BitbucketAccessToken  string `json:"bitbucketAccessToken,omitempty"`
+	BitbucketRefreshToken string `json:"bitbucketRefreshToken,omitempty"`
+
+	// SCM selects which pull-request webhook backend to use: "bitbucket"
+	// (the default), "github", or "gitea".
+	SCM string `json:"scm,omitempty"`
+
+	BitbucketWebhookSecret string `json:"bitbucketWebhookSecret,omitempty"`
+
+	GitHubURL           URL    `json:"githubURL,omitempty"`
+	GitHubToken         string `json:"githubToken,omitempty"`
+	GitHubWebhookSecret string `json:"githubWebhookSecret,omitempty"`
+
+	GiteaURL           URL    `json:"giteaURL,omitempty"`
+	GiteaToken         string `json:"giteaToken,omitempty"`
+	GiteaWebhookSecret string `json:"giteaWebhookSecret,omitempty"`
+
+	// LogDir, if set, persists every log record as a line of JSON under
+	// this directory, rotated daily. Leave empty to keep logs in memory
+	// only.
+	LogDir        string `json:"logDir,omitempty"`
+	MaxLogEntries int    `json:"maxLogEntries,omitempty"`
+	MaxLogBytes   int    `json:"maxLogBytes,omitempty"`
+
+	// QueueFile, if set, persists pending bot-mutation jobs as JSON to this
+	// path so a restart doesn't drop in-flight PR events. Leave empty to
+	// keep the queue in memory only.
+	QueueFile    string `json:"queueFile,omitempty"`
+	QueueWorkers int    `json:"queueWorkers,omitempty"`
+}
+
+// New returns a Config populated with tsukurogami's defaults.
+func New() *Config {
+	c := &Config{SCM: "bitbucket", MaxLogEntries: 10000, MaxLogBytes: 10 * 1024 * 1024, QueueWorkers: 4}
+	c.XcodeTimeout = Duration{30 * time.Second}
+	c.BitbucketTimeout = Duration{30 * time.Second}
+	u, _ := url.Parse("https://localhost:20343/api/bots")
+	c.XcodeURL = URL{u}
+	gh, _ := url.Parse("https://api.github.com")
+	c.GitHubURL = URL{gh}
+	return c
+}
+
+// RegisterFlags registers c's fields on fs so they can be set from the
+// command line when -config isn't used.
+func RegisterFlags(fs *flag.FlagSet, c *Config) {
+	fs.Var(&c.XcodeURL, "xcodeURL", "The url of your xcode server")
+	fs.Var(&c.BitbucketURL, "bitbucketURL", "The url of your bitbucket server")
+	fs.StringVar(&c.XcodeCredentials, "xcodeCredentials", "", "The credentials for your xcode server. username:password")
+	fs.StringVar(&c.BitbucketCredentials, "bitbucketCredentials", "", "The credentials for your bitbucket server. username:password")
+	fs.BoolVar(&c.BitbucketOAuth, "bitbucketOAuth", false, "Authenticate to bitbucket with an OAuth app instead of bitbucketCredentials")
+	fs.StringVar(&c.BitbucketClientID, "bitbucketClientID", "", "The OAuth app client id, if bitbucketOAuth is set")
+	fs.StringVar(&c.BitbucketClientSecret, "bitbucketClientSecret", "", "The OAuth app client secret, if bitbucketOAuth is set")
+	fs.Var(&c.BitbucketTokenURL, "bitbucketTokenURL", "The OAuth token endpoint, if bitbucketOAuth is set")
+	fs.StringVar(&c.BitbucketWebhookSecret, "bitbucketWebhookSecret", "", "Secret Bitbucket signs its webhooks with, checked against the X-Hub-Signature header")
+	fs.IntVar(&c.Port, "port", 4444, "The port to listen on")
+	fs.BoolVar(&c.SkipVerify, "skipVerify", true, "Skip certification verification on both servers")
+	fs.Var(&c.XcodeTimeout, "xcodeTimeout", "Deadline for a single HTTP round trip to the Xcode server (e.g. 30s). Zero disables it")
+	fs.Var(&c.BitbucketTimeout, "bitbucketTimeout", "Deadline for a single HTTP round trip to Bitbucket (e.g. 30s). Zero disables it")
+
+	fs.StringVar(&c.SCM, "scm", "bitbucket", `Which pull-request webhook backend to use: "bitbucket", "github", or "gitea"`)
+	fs.Var(&c.GitHubURL, "githubURL", "The API url of your GitHub (Enterprise) instance")
+	fs.StringVar(&c.GitHubToken, "githubToken", "", "A personal access token with repo:status scope, if scm is github")
+	fs.StringVar(&c.GitHubWebhookSecret, "githubWebhookSecret", "", "The webhook secret configured on your GitHub app/hook, if scm is github")
+	fs.Var(&c.GiteaURL, "giteaURL", "The API url of your Gitea instance")
+	fs.StringVar(&c.GiteaToken, "giteaToken", "", "An access token with repo:status scope, if scm is gitea")
+	fs.StringVar(&c.GiteaWebhookSecret, "giteaWebhookSecret", "", "The webhook secret configured on your Gitea hook, if scm is gitea")
+
+	fs.StringVar(&c.LogDir, "logDir", "", "If set, persist logs as daily-rotated JSON files under this directory")
+	fs.IntVar(&c.MaxLogEntries, "maxLogEntries", 10000, "The number of log records to keep in memory for /logs")
+	fs.IntVar(&c.MaxLogBytes, "maxLogBytes", 10*1024*1024, "The approximate number of bytes of log records to keep in memory for /logs")
+
+	fs.StringVar(&c.QueueFile, "queueFile", "", "If set, persist pending bot-mutation jobs as JSON to this path so a restart doesn't drop in-flight PR events")
+	fs.IntVar(&c.QueueWorkers, "queueWorkers", 4, "The number of worker goroutines processing the bot-mutation job queue")
+}
+
+// Load reads the JSON config file at path into c, overwriting any values
+// already set from flags.
+func Load(path string, c *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(contents, c)
+}
+
+// Save writes c back to path as JSON, used to persist rotated OAuth tokens.
+func Save(path string, c *Config) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Verify reports whether c has everything tsukurogami needs to run.
+func Verify(c *Config) bool {
+	if c.XcodeURL.String() == "" || c.XcodeCredentials == "" {
+		return false
+	}
+
+	switch c.SCM {
+	case "github":
+		return c.GitHubURL.String() != "" && c.GitHubToken != ""
+	case "gitea":
+		return c.GiteaURL.String() != "" && c.GiteaToken != ""
+	default:
+		if c.BitbucketURL.String() == "" {
+			return false
+		}
+		if c.BitbucketOAuth {
+			return c.BitbucketClientID != "" && c.BitbucketClientSecret != "" && c.BitbucketTokenURL.String() != ""
+		}
+		return c.BitbucketCredentials != ""
+	}
+}
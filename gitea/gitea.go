@@ -0,0 +1,148 @@
+// Package gitea implements tsukurogami's scm.SCM against Gitea's pull
+// request webhooks and commit status API.
+package gitea
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Didact/Tsukurogami/scm"
+)
+
+// SCM adapts a Gitea repo to the scm.SCM interface.
+type SCM struct {
+	HTTPClient *http.Client
+	// BaseURL is the API root, e.g. "https://gitea.example.com/api/v1".
+	BaseURL string
+	// Token authenticates status POSTs as "token <Token>".
+	Token string
+	// WebhookSecret, if set, must match the request's X-Gitea-Signature
+	// HMAC.
+	WebhookSecret string
+}
+
+// NewSCM returns a Gitea scm.SCM.
+func NewSCM(client *http.Client, baseURL, token, webhookSecret string) *SCM {
+	return &SCM{HTTPClient: client, BaseURL: baseURL, Token: token, WebhookSecret: webhookSecret}
+}
+
+type pullRequestWebhook struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		Head struct {
+			Ref string `json:"ref"`
+			Sha string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+func (s *SCM) ParseWebhook(r *http.Request) (scm.Event, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return scm.Event{}, fmt.Errorf("ParseWebhook: %s", err)
+	}
+
+	if s.WebhookSecret != "" {
+		if !validSignature(body, s.WebhookSecret, r.Header.Get("X-Gitea-Signature")) {
+			return scm.Event{}, scm.ErrInvalidSignature
+		}
+	}
+
+	if r.Header.Get("X-Gitea-Event") != "pull_request" {
+		return scm.Event{Action: scm.ActionUnknown}, nil
+	}
+
+	var payload pullRequestWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return scm.Event{}, fmt.Errorf("ParseWebhook: %s", err)
+	}
+
+	event := scm.Event{
+		Repo:   payload.Repository.FullName,
+		Branch: payload.PullRequest.Head.Ref,
+		Commit: payload.PullRequest.Head.Sha,
+	}
+
+	switch payload.Action {
+	case "opened":
+		event.Action = scm.ActionOpened
+	case "reopened":
+		event.Action = scm.ActionReopened
+	case "synchronize", "synchronized":
+		event.Action = scm.ActionSynchronize
+	case "closed":
+		event.Action = scm.ActionClosed
+	default:
+		event.Action = scm.ActionUnknown
+	}
+
+	return event, nil
+}
+
+// validSignature checks a hex-encoded HMAC-SHA256, unlike GitHub's
+// "sha256=" prefixed X-Hub-Signature-256.
+func validSignature(body []byte, secret, header string) bool {
+	want, err := hex.DecodeString(header)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	got := mac.Sum(nil)
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func (s *SCM) PostBuildStatus(repo, commit string, status scm.Status) error {
+	var state string
+	switch status.State {
+	case scm.StateSuccess:
+		state = "success"
+	case scm.StateFailure:
+		state = "failure"
+	default:
+		state = "pending"
+	}
+
+	body := struct {
+		State       string `json:"state"`
+		TargetURL   string `json:"target_url,omitempty"`
+		Description string `json:"description,omitempty"`
+		Context     string `json:"context,omitempty"`
+	}{State: state, TargetURL: status.URL, Description: status.Desc, Context: status.Key}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/repos/%s/statuses/%s", s.BaseURL, repo, commit), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+	req.Header.Set("Authorization", "token "+s.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("PostBuildStatus: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("PostBuildStatus: RPC failed (code: %d)", resp.StatusCode)
+	}
+
+	return nil
+}
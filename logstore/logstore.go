@@ -0,0 +1,225 @@
+// Package logstore is tsukurogami's structured, size-bounded log store. It
+// keeps a ring buffer of recent records in memory for /logs to serve,
+// optionally mirrors them to an operator's console, and persists them to
+// daily-rotated files under a log directory.
+package logstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a single structured log line.
+type Record struct {
+	Time        time.Time `json:"ts"`
+	Level       string    `json:"level"`
+	Repo        string    `json:"repo,omitempty"`
+	Branch      string    `json:"branch,omitempty"`
+	Bot         string    `json:"bot,omitempty"`
+	Integration string    `json:"integration,omitempty"`
+	Msg         string    `json:"msg"`
+}
+
+func (r Record) text() string {
+	return fmt.Sprintf("%s [%s] %s\n", r.Time.Format(time.RFC3339), r.Level, r.Msg)
+}
+
+// Store is a ring-buffered, disk-persisted log store. The zero value isn't
+// usable; use New.
+type Store struct {
+	m          sync.Mutex
+	records    []Record
+	bytes      int
+	maxEntries int
+	maxBytes   int
+
+	dir        string
+	file       *os.File
+	fileDate   string
+	fileFailed bool // avoid re-logging the same open failure on every record
+
+	// Console, if set, also receives a human-readable rendering of every
+	// record (tsukurogami wires this to os.Stdout).
+	Console io.Writer
+}
+
+// New returns a Store that keeps at most maxEntries records (or maxBytes of
+// serialized records, whichever is hit first) in memory, and persists every
+// record as a line of JSON under dir, rotated daily. dir may be empty to
+// disable persistence.
+func New(dir string, maxEntries, maxBytes int) (*Store, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("logstore: %s", err)
+		}
+	}
+	return &Store{dir: dir, maxEntries: maxEntries, maxBytes: maxBytes}, nil
+}
+
+// Entry is a Store bound to a fixed set of fields (repo/branch/bot/
+// integration), so call sites don't have to repeat them on every call.
+type Entry struct {
+	store                          *Store
+	repo, branch, bot, integration string
+}
+
+// With returns an Entry scoped to repo and branch.
+func (s *Store) With(repo, branch string) *Entry {
+	return &Entry{store: s, repo: repo, branch: branch}
+}
+
+// WithBot returns a copy of e additionally scoped to bot.
+func (e Entry) WithBot(bot string) *Entry {
+	e.bot = bot
+	return &e
+}
+
+// WithIntegration returns a copy of e additionally scoped to integration.
+func (e Entry) WithIntegration(integration string) *Entry {
+	e.integration = integration
+	return &e
+}
+
+// Infof records an info-level line.
+func (e *Entry) Infof(format string, args ...interface{}) {
+	e.store.write("info", e.repo, e.branch, e.bot, e.integration, fmt.Sprintf(format, args...))
+}
+
+// Errorf records an error-level line.
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	e.store.write("error", e.repo, e.branch, e.bot, e.integration, fmt.Sprintf(format, args...))
+}
+
+func (s *Store) write(level, repo, branch, bot, integration, msg string) {
+	rec := Record{Time: time.Now(), Level: level, Repo: repo, Branch: branch, Bot: bot, Integration: integration, Msg: msg}
+
+	if s.Console != nil {
+		io.WriteString(s.Console, rec.text())
+	}
+
+	s.append(rec)
+}
+
+// append adds rec to the ring buffer, evicting the oldest records past
+// maxEntries/maxBytes, and persists it to disk. Unlike write, it never
+// touches Console, since Write's callers (the standard log package) already
+// reach the operator's console through their own MultiWriter.
+func (s *Store) append(rec Record) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.records = append(s.records, rec)
+	s.bytes += len(b)
+	for (s.maxEntries > 0 && len(s.records) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		evicted, err := json.Marshal(s.records[0])
+		if err == nil {
+			s.bytes -= len(evicted)
+		}
+		s.records = s.records[1:]
+	}
+
+	s.persist(b)
+}
+
+// Write implements io.Writer so the standard log package can be pointed at
+// a Store (e.g. log.SetOutput(io.MultiWriter(os.Stdout, store))), making
+// log.Print/Fatal output filterable through /logs alongside structured
+// Entry records. Every line is recorded at error level, repo/branch/bot/
+// integration left blank, since the log package carries no structured
+// fields to fill them with.
+func (s *Store) Write(p []byte) (int, error) {
+	s.append(Record{Time: time.Now(), Level: "error", Msg: strings.TrimRight(string(p), "\n")})
+	return len(p), nil
+}
+
+// persist appends b (a single marshaled Record, without its trailing
+// newline) to today's log file, rotating if the date has changed. A failure
+// to open the file is only surfaced to Console, and write errors are
+// dropped, since a disk hiccup shouldn't take down log serving from the
+// in-memory ring.
+func (s *Store) persist(b []byte) {
+	if s.dir == "" {
+		return
+	}
+
+	today := time.Now().Format("2006-01-02")
+	if s.file == nil || s.fileDate != today {
+		if s.file != nil {
+			s.file.Close()
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, today+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			if !s.fileFailed && s.Console != nil {
+				fmt.Fprintf(s.Console, "logstore: couldn't open log file: %s\n", err)
+			}
+			s.fileFailed = true
+			s.file = nil
+			return
+		}
+		s.file = f
+		s.fileDate = today
+		s.fileFailed = false
+	}
+
+	s.file.Write(append(b, '\n'))
+}
+
+// ServeHTTP serves the records currently in the ring buffer, filtered by the
+// since/repo/branch/level query parameters and rendered as either
+// newline-delimited JSON (the default) or plain text (?format=text).
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		}
+	}
+	repo := q.Get("repo")
+	branch := q.Get("branch")
+	level := q.Get("level")
+	text := q.Get("format") == "text"
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, rec := range s.records {
+		if !since.IsZero() && !rec.Time.After(since) {
+			continue
+		}
+		if repo != "" && !strings.EqualFold(rec.Repo, repo) {
+			continue
+		}
+		if branch != "" && !strings.EqualFold(rec.Branch, branch) {
+			continue
+		}
+		if level != "" && !strings.EqualFold(rec.Level, level) {
+			continue
+		}
+
+		if text {
+			io.WriteString(w, rec.text())
+			continue
+		}
+
+		b, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		w.Write(b)
+		w.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,201 @@
+// Package metrics is a minimal Prometheus text-exposition-format writer:
+// just enough CounterVec/HistogramVec to let tsukurogami expose /metrics
+// without pulling in a client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// collector writes its current value(s) in Prometheus text exposition
+// format to w.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry collects every metric registered on it and serves them as
+// Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounterVec registers and returns a new CounterVec on r.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// NewHistogramVec registers and returns a new HistogramVec on r, with
+// cumulative buckets at the given upper bounds (which need not be sorted).
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{name: name, help: help, labelNames: labelNames, buckets: sorted, values: make(map[string]*histogramValue)}
+	r.register(h)
+	return h
+}
+
+// ServeHTTP writes every registered metric as Prometheus text exposition
+// format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.collectors {
+		c.write(w)
+	}
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// escape applies the Prometheus label-value escaping rules.
+func escape(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return v
+}
+
+// labelString renders {name="value",...} for the given names/values followed
+// by any extra name/value pairs, or "" if there are neither.
+func labelString(names, values []string, extra ...[2]string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, escape(values[i])))
+	}
+	for _, e := range extra {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, e[0], escape(e[1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a monotonically increasing counter, partitioned by a fixed
+// set of label names.
+type CounterVec struct {
+	name, help string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Inc increments the counter for the given label values (in the same order
+// as labelNames) by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values := strings.Split(k, "\x00")
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labelString(c.labelNames, values), c.values[k])
+	}
+}
+
+// histogramValue is one label combination's observations: a cumulative
+// count per bucket upper bound, plus the running sum and total count.
+type histogramValue struct {
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// HistogramVec tracks the distribution of observed values (e.g. request
+// durations) in cumulative buckets, partitioned by a fixed set of label
+// names.
+type HistogramVec struct {
+	name, help string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// Observe records v for the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := labelKey(labelValues)
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{bucketCounts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.bucketCounts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values := strings.Split(k, "\x00")
+		hv := h.values[k]
+
+		for i, bound := range h.buckets {
+			le := labelString(h.labelNames, values, [2]string{"le", fmt.Sprintf("%g", bound)})
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, hv.bucketCounts[i])
+		}
+		le := labelString(h.labelNames, values, [2]string{"le", "+Inf"})
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, hv.count)
+
+		labels := labelString(h.labelNames, values)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labels, hv.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
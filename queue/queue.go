@@ -0,0 +1,288 @@
+// Package queue is tsukurogami's durable job queue for bot mutations. Jobs
+// are keyed by (repo, branch); the queue guarantees at most one job per key
+// runs at a time, and a newer job enqueued for a key that already has one
+// pending replaces it rather than queueing a second one (except that an
+// integrate never replaces a pending create; see Enqueue), so a burst of
+// webhook retries for the same branch collapses into a single mutation.
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kind is the type of bot mutation a Job performs.
+type Kind int
+
+const (
+	KindCreate Kind = iota
+	KindDelete
+	KindIntegrate
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCreate:
+		return "create"
+	case KindDelete:
+		return "delete"
+	case KindIntegrate:
+		return "integrate"
+	default:
+		return "unknown"
+	}
+}
+
+func (k Kind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+func (k *Kind) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "create":
+		*k = KindCreate
+	case "delete":
+		*k = KindDelete
+	case "integrate":
+		*k = KindIntegrate
+	default:
+		return fmt.Errorf("queue: unknown job kind %q", s)
+	}
+	return nil
+}
+
+// Job is a single bot mutation to run for a repo/branch.
+type Job struct {
+	Kind     Kind      `json:"kind"`
+	Repo     string    `json:"repo"`
+	Branch   string    `json:"branch"`
+	Enqueued time.Time `json:"enqueued"`
+}
+
+func (j Job) key() string {
+	return j.Repo + "\x00" + j.Branch
+}
+
+// Handler runs a single Job. It's called by every worker goroutine, so it
+// must be safe for concurrent use.
+type Handler func(ctx context.Context, job Job) error
+
+// Queue is a persistent, per-key-serialized job queue. The zero value isn't
+// usable; use New.
+type Queue struct {
+	mu      sync.Mutex
+	pending map[string]Job // key -> latest not-yet-dispatched job
+	order   []string       // FIFO of keys with pending work
+	running map[string]Job // key -> job currently executing
+
+	path    string // JSON file jobs are persisted to; empty disables persistence
+	handler Handler
+	wake    chan struct{}
+}
+
+// New returns a Queue that dispatches jobs to handler, persisting pending
+// (not yet started) jobs as JSON under path so they survive a restart. path
+// may be empty to disable persistence.
+func New(path string, handler Handler) (*Queue, error) {
+	q := &Queue{
+		pending: make(map[string]Job),
+		running: make(map[string]Job),
+		path:    path,
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+	}
+
+	if path != "" {
+		if err := q.load(); err != nil {
+			return nil, fmt.Errorf("queue: %s", err)
+		}
+	}
+
+	return q, nil
+}
+
+// Enqueue adds job to the queue. If a job is already pending for job's
+// (repo, branch), it's replaced by job rather than queued separately, with
+// one exception: a pending KindCreate is never replaced by a KindIntegrate,
+// since the create handler already integrates once the bot exists, and
+// dropping the create would leave the branch with no bot at all.
+func (q *Queue) Enqueue(job Job) {
+	job.Enqueued = time.Now()
+
+	q.mu.Lock()
+	k := job.key()
+	existing, exists := q.pending[k]
+	if !exists {
+		q.order = append(q.order, k)
+		q.pending[k] = job
+	} else if existing.Kind == KindCreate && job.Kind == KindIntegrate {
+		// Keep the pending create; it'll integrate on its own.
+	} else {
+		q.pending[k] = job
+	}
+	q.persistLocked()
+	q.mu.Unlock()
+
+	q.notify()
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue pops the oldest pending job whose key isn't already running, and
+// marks that key running.
+func (q *Queue) dequeue() (Job, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, k := range q.order {
+		if _, busy := q.running[k]; busy {
+			continue
+		}
+		job := q.pending[k]
+		delete(q.pending, k)
+		q.order = append(q.order[:i:i], q.order[i+1:]...)
+		q.running[k] = job
+		q.persistLocked()
+		return job, k, true
+	}
+
+	return Job{}, "", false
+}
+
+// release marks k no longer running, and wakes a worker if a job queued
+// while k was running.
+func (q *Queue) release(k string) {
+	q.mu.Lock()
+	delete(q.running, k)
+	_, hasPending := q.pending[k]
+	q.mu.Unlock()
+
+	if hasPending {
+		q.notify()
+	}
+}
+
+// Run starts n worker goroutines pulling jobs from q until ctx is done.
+func (q *Queue) Run(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		job, k, ok := q.dequeue()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+				continue
+			}
+		}
+
+		if err := q.handler(ctx, job); err != nil {
+			log.Printf("queue: %s %s/%s: %s", job.Kind, job.Repo, job.Branch, err)
+		}
+
+		q.release(k)
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// persistLocked writes every pending job to q.path as JSON, in FIFO order.
+// Must be called with q.mu held. Jobs that are currently running aren't
+// persisted; a crash mid-job re-delivers nothing for it, same as a dropped
+// webhook would.
+func (q *Queue) persistLocked() {
+	if q.path == "" {
+		return
+	}
+
+	jobs := make([]Job, 0, len(q.order))
+	for _, k := range q.order {
+		jobs = append(jobs, q.pending[k])
+	}
+
+	b, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		log.Printf("queue: couldn't marshal for persistence: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(q.path, b, 0644); err != nil {
+		log.Printf("queue: couldn't persist: %s", err)
+	}
+}
+
+func (q *Queue) load() error {
+	b, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var jobs []Job
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		k := j.key()
+		if _, exists := q.pending[k]; !exists {
+			q.order = append(q.order, k)
+		}
+		q.pending[k] = j
+	}
+
+	return nil
+}
+
+// ServeHTTP reports the queue's current pending and running jobs as JSON,
+// for operator inspection.
+func (q *Queue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out struct {
+		Pending []Job `json:"pending"`
+		Running []Job `json:"running"`
+	}
+	for _, k := range q.order {
+		out.Pending = append(out.Pending, q.pending[k])
+	}
+	for _, job := range q.running {
+		out.Running = append(out.Running, job)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
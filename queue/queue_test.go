@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"context"
+	"testing"
+)
+
+func noopHandler(ctx context.Context, job Job) error { return nil }
+
+func TestEnqueue_IntegrateDoesNotReplacePendingCreate(t *testing.T) {
+	q, err := New("", noopHandler)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	q.Enqueue(Job{Kind: KindCreate, Repo: "r", Branch: "b"})
+	q.Enqueue(Job{Kind: KindIntegrate, Repo: "r", Branch: "b"})
+
+	k := Job{Repo: "r", Branch: "b"}.key()
+	if got := q.pending[k].Kind; got != KindCreate {
+		t.Fatalf("pending job kind = %s, want %s: an integrate arriving behind a pending create must not drop the create", got, KindCreate)
+	}
+	if n := len(q.order); n != 1 {
+		t.Fatalf("len(order) = %d, want 1: the integrate should coalesce, not queue separately", n)
+	}
+}
+
+func TestEnqueue_CoalescesOtherwise(t *testing.T) {
+	q, err := New("", noopHandler)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	q.Enqueue(Job{Kind: KindIntegrate, Repo: "r", Branch: "b"})
+	q.Enqueue(Job{Kind: KindDelete, Repo: "r", Branch: "b"})
+
+	k := Job{Repo: "r", Branch: "b"}.key()
+	if got := q.pending[k].Kind; got != KindDelete {
+		t.Fatalf("pending job kind = %s, want %s: a later job should still replace a pending non-create", got, KindDelete)
+	}
+	if n := len(q.order); n != 1 {
+		t.Fatalf("len(order) = %d, want 1", n)
+	}
+}
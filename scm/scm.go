@@ -0,0 +1,98 @@
+// Package scm generalizes tsukurogami's pull-request webhook handling and
+// build-status posting behind a single interface, so Bitbucket Server isn't
+// the only SCM it can watch.
+package scm
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrInvalidSignature is returned by ParseWebhook when the request's
+// signature/shared-secret doesn't match the configured one.
+var ErrInvalidSignature = errors.New("scm: invalid webhook signature")
+
+// Action is the normalized pull-request lifecycle event a webhook reported.
+type Action int
+
+const (
+	ActionUnknown Action = iota
+	ActionOpened
+	ActionReopened
+	// ActionSynchronize is a PR whose branch moved (new commits pushed,
+	// rebase, etc.) and whose bot should simply be re-integrated.
+	ActionSynchronize
+	// ActionClosed covers both merged and declined/rejected PRs; either way
+	// the bot should be torn down.
+	ActionClosed
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionOpened:
+		return "opened"
+	case ActionReopened:
+		return "reopened"
+	case ActionSynchronize:
+		return "synchronize"
+	case ActionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a normalized pull-request webhook.
+type Event struct {
+	Repo   string
+	Branch string
+	Commit string
+	Action Action
+}
+
+// State is a normalized build result, independent of any one SCM's
+// vocabulary for it.
+type State int
+
+const (
+	StatePending State = iota
+	StateInProgress
+	StateSuccess
+	StateFailure
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateInProgress:
+		return "in progress"
+	case StateSuccess:
+		return "success"
+	case StateFailure:
+		return "failure"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is a build result to post back to the SCM for a commit.
+type Status struct {
+	State State
+	// Key uniquely identifies this status among others on the same commit
+	// (Bitbucket's build-status key, GitHub/Gitea's status context).
+	Key  string
+	Name string
+	URL  string
+	Desc string
+}
+
+// SCM is the set of operations tsukurogami needs from a source control host:
+// turning a raw webhook request into a normalized Event, and posting a build
+// Status back for a commit. Implementations are responsible for verifying
+// the webhook's signature/shared-secret as part of ParseWebhook, so the
+// handler enforces it uniformly across backends.
+type SCM interface {
+	ParseWebhook(r *http.Request) (Event, error)
+	PostBuildStatus(repo, commit string, status Status) error
+}
@@ -0,0 +1,485 @@
+// Package xcode talks to an Xcode Server's bot RPC API. It exposes an
+// XcodeClient interface so bot-mutation logic elsewhere can be unit tested
+// against a fake instead of a real server.
+package xcode
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Didact/Tsukurogami/metrics"
+)
+
+var switchBranch = `
+#!/bin/sh
+set -x
+cd ${XCS_PRIMARY_REPO_DIR}
+git fetch
+git checkout "%s"
+git pull # for good measure
+git merge --no-ff --no-commit master
+`
+
+var pokeStatus = `
+#!/bin/sh
+set -x
+cd ${XCS_PRIMARY_REPO_DIR}
+curl -g "%s:%d/integrationUpdated?commit=$(git rev-parse HEAD | tr -d \n)&bot=${XCS_BOT_NAME}&integration=${XCS_INTEGRATION_NUMBER}&status=%s"
+`
+
+// Trigger is an Xcode bot pre/post-integration trigger script.
+type Trigger struct {
+	Phase              int              `json:"phase"`
+	Body               string           `json:"scriptBody,omitempty"`
+	Name               string           `json:"name"`
+	Type               int              `json:"type"`
+	EmailConfiguration *json.RawMessage `json:"emailConfiguration,omitempty"`
+	Conditions         struct {
+		OnAnalyzerWarnings bool `json:"onAnalyzerWarnings"`
+		OnBuildErrors      bool `json:"onBuildErrors"`
+		OnFailingTests     bool `json:"onFailingTests"`
+		OnSuccess          bool `json:"onSuccess"`
+		OnWarnings         bool `json:"onWarnings"`
+		Status             int  `json:"status"`
+	} `json:"conditions,omitempty"`
+}
+
+// Bot is an Xcode Server bot.
+type Bot struct {
+	ID     string        `json:"_id,omitempty"`
+	Name   string        `json:"name"`
+	Config Configuration `json:"configuration"`
+}
+
+// Configuration is a Bot's build configuration. Xcode's bot configuration
+// documents carry many fields tsukurogami doesn't care about, so m holds
+// whatever was there untouched and only triggers/envVars/scheduleType are
+// unpacked for inspection and mutation.
+type Configuration struct {
+	m            map[string]*json.RawMessage
+	triggers     []Trigger
+	envVars      map[string]interface{}
+	scheduleType int
+}
+
+func (c Configuration) MarshalJSON() ([]byte, error) {
+	triggerJSON, err := json.Marshal(c.triggers)
+	if err != nil {
+		return nil, err
+	}
+	envJSON, err := json.Marshal(c.envVars)
+	if err != nil {
+		return nil, err
+	}
+	scheduleJSON, err := json.Marshal(c.scheduleType)
+	if err != nil {
+		return nil, err
+	}
+	t := json.RawMessage(triggerJSON)
+	e := json.RawMessage(envJSON)
+	s := json.RawMessage(scheduleJSON)
+	c.m["triggers"] = &t
+	c.m["buildEnvironmentVariables"] = &e
+	c.m["scheduleType"] = &s
+	return json.Marshal(c.m)
+}
+
+func (c *Configuration) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &c.m); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(*c.m["triggers"], &c.triggers); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(*c.m["buildEnvironmentVariables"], &c.envVars); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(*c.m["scheduleType"], &c.scheduleType); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnvVars exposes the bot's buildEnvironmentVariables for read/write access
+// from outside the package (e.g. to stamp TSUKUROGAMI_REPO/BRANCH).
+func (c *Configuration) EnvVars() map[string]interface{} {
+	return c.envVars
+}
+
+// Triggers returns the bot's trigger list.
+func (c *Configuration) Triggers() []Trigger {
+	return c.triggers
+}
+
+// SetTriggers replaces the bot's trigger list.
+func (c *Configuration) SetTriggers(triggers []Trigger) {
+	c.triggers = triggers
+}
+
+// SetScheduleType sets the bot's scheduleType (3 == manual/on-push in Xcode
+// Server's API).
+func (c *Configuration) SetScheduleType(t int) {
+	c.scheduleType = t
+}
+
+// NewTrigger builds a Trigger with the given phase/name/script body, and no
+// conditions set.
+func NewTrigger(phase int, name, body string) Trigger {
+	return Trigger{Type: 1, Phase: phase, Name: name, Body: body}
+}
+
+// SwitchBranchTrigger is the pre-integration trigger that checks out branch
+// before a bot's build runs.
+func SwitchBranchTrigger(branch string) Trigger {
+	return NewTrigger(1, "Switch Branch", fmt.Sprintf(switchBranch, branch))
+}
+
+// PrePoke is the pre-integration trigger that reports "inprogress" back to
+// tsukurogami at myIP:port.
+func PrePoke(myIP string, port int) Trigger {
+	return NewTrigger(1, "Update Status", fmt.Sprintf(pokeStatus, myIP, port, "inprogress"))
+}
+
+// PostPoke is the post-integration trigger that reports the integration's
+// terminal result back to tsukurogami at myIP:port.
+func PostPoke(myIP string, port int) Trigger {
+	t := NewTrigger(2, "Update Status", fmt.Sprintf(pokeStatus, myIP, port, "${XCS_INTEGRATION_RESULT}"))
+	t.Conditions.OnWarnings = true
+	t.Conditions.OnSuccess = true
+	t.Conditions.OnFailingTests = true
+	t.Conditions.OnBuildErrors = true
+	t.Conditions.OnAnalyzerWarnings = true
+	return t
+}
+
+// XcodeClient is the set of Xcode Server bot RPCs tsukurogami needs. It's an
+// interface so the bot-mutation logic that builds on it can be tested
+// against a fake instead of a real server.
+type XcodeClient interface {
+	ListBots(ctx context.Context) ([]Bot, error)
+	CreateBot(ctx context.Context, bot Bot) (Bot, error)
+	DeleteBot(ctx context.Context, id string) error
+	Integrate(ctx context.Context, id string) error
+	Duplicate(ctx context.Context, id string, bot Bot) error
+}
+
+// transport injects a static Basic credential into every request, same as
+// tsukurogami's xcode server auth has always worked. If timeout is set, it
+// also bounds every round trip with a deadline, so a wedged Xcode server
+// can't hang a webhook handler forever.
+type transport struct {
+	*http.Transport
+	creds   string
+	timeout time.Duration
+}
+
+// NewTransport returns an http.RoundTripper that authenticates to the Xcode
+// server with creds ("username:password") and bounds every request to
+// timeout (zero disables the deadline).
+func NewTransport(creds string, skipVerify bool, timeout time.Duration) http.RoundTripper {
+	return transport{creds: creds, timeout: timeout, Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify}}}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(t.creds)))
+	req.Header.Add("Authorization", auth)
+
+	if t.timeout <= 0 {
+		return t.Transport.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's deadline context once its response body
+// is closed, instead of the moment the round trip returns, since callers are
+// still reading the body after RoundTrip returns.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// doWithRetry retries newReq/client.Do with exponential backoff on network
+// errors and 5xx responses, since Duplicate is idempotent by name (a
+// same-named bot 409s rather than duplicating) and safe to resend.
+func doWithRetry(client *http.Client, newReq func() (*http.Request, error)) (*http.Response, error) {
+	const maxAttempts = 4
+	backoff := 250 * time.Millisecond
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("RPC failed (code: %d)", resp.StatusCode)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("giving up after %d attempts: %s", maxAttempts, lastErr)
+}
+
+// Client is the http-backed XcodeClient implementation.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	// rpcErrors, if set, counts failed RPCs by operation name
+	// (tsukurogami_xcode_rpc_errors_total{op}).
+	rpcErrors *metrics.CounterVec
+}
+
+// NewClient returns a Client that talks to baseURL (tsukurogami's
+// config.Config.XcodeURL) using httpClient. rpcErrors may be nil to disable
+// RPC error counting.
+func NewClient(httpClient *http.Client, baseURL string, rpcErrors *metrics.CounterVec) *Client {
+	return &Client{httpClient: httpClient, baseURL: baseURL, rpcErrors: rpcErrors}
+}
+
+// fail counts a failed op (if rpcErrors is set) and returns err unchanged,
+// so call sites can write "return c.fail(\"op\", err)".
+func (c *Client) fail(op string, err error) error {
+	if c.rpcErrors != nil {
+		c.rpcErrors.Inc(op)
+	}
+	return err
+}
+
+func (c *Client) ListBots(ctx context.Context) ([]Bot, error) {
+	var botList struct {
+		Count   int   `json:"count"`
+		Results []Bot `json:"results"`
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL, nil)
+	if err != nil {
+		return nil, c.fail("ListBots", fmt.Errorf("ListBots: %s", err))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, c.fail("ListBots", fmt.Errorf("ListBots: %s", err))
+	}
+	if resp.Body == nil {
+		return nil, c.fail("ListBots", fmt.Errorf("ListBots: no response from server"))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, c.fail("ListBots", fmt.Errorf("ListBots: %s", err))
+	}
+
+	if err := json.Unmarshal(body, &botList); err != nil {
+		return nil, c.fail("ListBots", fmt.Errorf("ListBots: %s", err))
+	}
+
+	if botList.Count == 0 {
+		return nil, c.fail("ListBots", errors.New("ListBots: no bots"))
+	}
+
+	return botList.Results, nil
+}
+
+func (c *Client) CreateBot(ctx context.Context, bot Bot) (Bot, error) {
+	b, err := json.Marshal(bot)
+	if err != nil {
+		return Bot{}, fmt.Errorf("CreateBot: %s", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL, bytes.NewReader(b))
+	if err != nil {
+		return Bot{}, c.fail("CreateBot", fmt.Errorf("CreateBot: %s", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Bot{}, c.fail("CreateBot", fmt.Errorf("CreateBot: %s", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return Bot{}, c.fail("CreateBot", fmt.Errorf("CreateBot: RPC failed (code: %d)", resp.StatusCode))
+	}
+
+	var created Bot
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Bot{}, c.fail("CreateBot", fmt.Errorf("CreateBot: %s", err))
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return Bot{}, c.fail("CreateBot", fmt.Errorf("CreateBot: %s", err))
+	}
+
+	return created, nil
+}
+
+func (c *Client) DeleteBot(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/%s", c.baseURL, id), nil)
+	if err != nil {
+		return c.fail("DeleteBot", fmt.Errorf("DeleteBot: %s", err))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return c.fail("DeleteBot", fmt.Errorf("DeleteBot: %s", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 {
+		return c.fail("DeleteBot", fmt.Errorf("DeleteBot: RPC failed (code %d)", resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (c *Client) Integrate(ctx context.Context, id string) error {
+	// downloading sources takes forever with shouldClean: true imo
+
+	// Unlike Duplicate, this isn't retried: a network error here doesn't
+	// tell us whether Xcode Server received the POST before or after it
+	// started the integration, and retrying a request that was in fact
+	// received kicks off a second build rather than a no-op.
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s/integrations", c.baseURL, id), strings.NewReader(`{"shouldClean": false}`))
+	if err != nil {
+		return c.fail("Integrate", fmt.Errorf("Integrate: %s", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return c.fail("Integrate", fmt.Errorf("Integrate: %s", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return c.fail("Integrate", fmt.Errorf("Integrate: RPC failed (code: %d)", resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (c *Client) Duplicate(ctx context.Context, id string, bot Bot) error {
+	b, err := json.Marshal(bot)
+	if err != nil {
+		return c.fail("Duplicate", fmt.Errorf("Duplicate: %s", err))
+	}
+
+	resp, err := doWithRetry(c.httpClient, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s/duplicate", c.baseURL, id), bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return c.fail("Duplicate", fmt.Errorf("Duplicate: %s", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return c.fail("Duplicate", fmt.Errorf("Duplicate: RPC failed (code: %d)", resp.StatusCode))
+	}
+
+	return nil
+}
+
+// BotsWhere returns every bot for which pred returns true.
+func BotsWhere(ctx context.Context, c XcodeClient, pred func(*Bot) bool) ([]*Bot, error) {
+	bots, err := c.ListBots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("BotsWhere: %s", err)
+	}
+	var result []*Bot
+	for i := range bots {
+		if pred(&bots[i]) {
+			result = append(result, &bots[i])
+		}
+	}
+	return result, nil
+}
+
+// BotNamed returns the bot with the given name (case-insensitive).
+func BotNamed(ctx context.Context, c XcodeClient, name string) (*Bot, error) {
+	bots, err := BotsWhere(ctx, c, func(b *Bot) bool {
+		return strings.ToLower(b.Name) == strings.ToLower(name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BotNamed: %s", err)
+	}
+
+	if len(bots) < 1 {
+		return nil, fmt.Errorf("BotNamed %s: no results", name)
+	}
+
+	return bots[0], nil
+}
+
+// PreferredIP returns the local address this host would use to reach
+// hostport, so Xcode trigger scripts know where to poke tsukurogami back.
+func PreferredIP(hostport string) string {
+	// expensive, I know, but seems more accurate than looping through net.Interfaces()
+	conn, err := net.Dial("tcp", hostport)
+	if err != nil {
+		return ""
+	}
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		// wtf
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if addr.IP.To4() == nil {
+		// ipv6 address
+		return "[" + host + "]"
+	}
+	return host
+}